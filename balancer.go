@@ -0,0 +1,184 @@
+package lantern
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ProxyStrategy selects how dialWithPolicy orders candidate addresses for a
+// direct dial.
+type ProxyStrategy string
+
+const (
+	// StrategySticky tries the address with the most recorded successful
+	// dials first.
+	StrategySticky ProxyStrategy = "sticky"
+	// StrategyRoundRobin tries candidate addresses in resolution order
+	// within a single dialWithPolicy call's retry attempts. It does not
+	// track state across separate calls, so it's not a rotation shared
+	// between connections -- every new connection restarts from the same
+	// resolution order.
+	StrategyRoundRobin ProxyStrategy = "roundrobin"
+	// StrategyFastest tries the address with the lowest recorded latency
+	// first.
+	StrategyFastest ProxyStrategy = "fastest"
+	// StrategyQoSWeighted is an alias of StrategyRoundRobin today; it's
+	// reserved for a future weighted-random implementation.
+	StrategyQoSWeighted ProxyStrategy = "qos"
+)
+
+// DirectDialPolicy controls how lantern's own direct-dial paths (SOCKS5
+// BypassDirect destinations) pick among candidate addresses and retry
+// failures within a single dial. This package has no access to flashlight's
+// internal balancer, so DirectDialPolicy has no effect on how flashlight
+// picks or retries the proxies it dials.
+type DirectDialPolicy struct {
+	// Strategy selects how candidate addresses are ordered. Defaults to
+	// StrategyRoundRobin if empty.
+	Strategy ProxyStrategy
+	// DialAttempts is the number of candidate addresses to try before
+	// giving up on a single connection. Defaults to 1 if 0.
+	DialAttempts int
+	// NoRepeatDialer, when true, skips the address used by the immediately
+	// preceding attempt within the same retry loop, so a single bad
+	// address can't be retried back-to-back.
+	NoRepeatDialer bool
+}
+
+func (p DirectDialPolicy) attempts() int {
+	if p.DialAttempts > 0 {
+		return p.DialAttempts
+	}
+	return 1
+}
+
+// DialerStat reports point-in-time health metrics for one of lantern's own
+// direct-dial destinations.
+type DialerStat struct {
+	Label         string
+	Successes     int64
+	Failures      int64
+	LastLatencyMs int64
+	EMALatencyMs  float64
+}
+
+var (
+	dialStatsMu sync.Mutex
+	dialStats   = map[string]*DialerStat{}
+)
+
+// emaAlpha weights the most recent latency sample against the running
+// average.
+const emaAlpha = 0.2
+
+func recordDialStat(label string, success bool, latency time.Duration) {
+	dialStatsMu.Lock()
+	defer dialStatsMu.Unlock()
+
+	s, ok := dialStats[label]
+	if !ok {
+		s = &DialerStat{Label: label}
+		dialStats[label] = s
+	}
+	if success {
+		s.Successes++
+	} else {
+		s.Failures++
+	}
+
+	ms := float64(latency) / float64(time.Millisecond)
+	s.LastLatencyMs = int64(ms)
+	if s.EMALatencyMs == 0 {
+		s.EMALatencyMs = ms
+	} else {
+		s.EMALatencyMs = emaAlpha*ms + (1-emaAlpha)*s.EMALatencyMs
+	}
+}
+
+// DialerStats returns a snapshot of per-destination health metrics for
+// dials lantern has performed directly (e.g. SOCKS5 BypassDirect), so an
+// embedder can render a connection-health screen.
+func DialerStats() []DialerStat {
+	dialStatsMu.Lock()
+	defer dialStatsMu.Unlock()
+
+	result := make([]DialerStat, 0, len(dialStats))
+	for _, s := range dialStats {
+		result = append(result, *s)
+	}
+	return result
+}
+
+// dialWithPolicy dials host:port directly, retrying across the resolved
+// addresses according to policy.
+func dialWithPolicy(policy DirectDialPolicy, host string, port int) (net.Conn, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return dialOnce(net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	addrs := orderAddrs(policy.Strategy, ips, port)
+
+	var lastErr error
+	var lastAddr string
+	attempts := policy.attempts()
+	for attempt := 0; attempt < attempts; attempt++ {
+		addr := addrs[attempt%len(addrs)]
+		if policy.NoRepeatDialer && len(addrs) > 1 && addr == lastAddr {
+			addr = addrs[(attempt+1)%len(addrs)]
+		}
+		conn, dialErr := dialOnce(addr)
+		lastAddr = addr
+		if dialErr == nil {
+			return conn, nil
+		}
+		lastErr = dialErr
+	}
+	return nil, lastErr
+}
+
+func dialOnce(addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := net.Dial("tcp", addr)
+	recordDialStat(addr, err == nil, time.Since(start))
+	return conn, err
+}
+
+func orderAddrs(strategy ProxyStrategy, ips []net.IP, port int) []string {
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+
+	switch strategy {
+	case StrategyFastest:
+		sortAddrsByScore(addrs, func(s *DialerStat) float64 {
+			if s == nil || s.EMALatencyMs == 0 {
+				return math.MaxFloat64
+			}
+			return s.EMALatencyMs
+		})
+	case StrategySticky:
+		sortAddrsByScore(addrs, func(s *DialerStat) float64 {
+			if s == nil {
+				return 0
+			}
+			return -float64(s.Successes)
+		})
+	}
+
+	return addrs
+}
+
+// sortAddrsByScore orders addrs ascending by score, lowest first.
+func sortAddrsByScore(addrs []string, score func(*DialerStat) float64) {
+	dialStatsMu.Lock()
+	defer dialStatsMu.Unlock()
+	sort.Slice(addrs, func(i, j int) bool {
+		return score(dialStats[addrs[i]]) < score(dialStats[addrs[j]])
+	})
+}
@@ -0,0 +1,43 @@
+package lantern
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOrderAddrsFastestPrefersLowerLatency(t *testing.T) {
+	dialStatsMu.Lock()
+	dialStats = map[string]*DialerStat{
+		"10.0.0.1:80": {Label: "10.0.0.1:80", EMALatencyMs: 200},
+		"10.0.0.2:80": {Label: "10.0.0.2:80", EMALatencyMs: 50},
+	}
+	dialStatsMu.Unlock()
+
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+	addrs := orderAddrs(StrategyFastest, ips, 80)
+
+	if addrs[0] != "10.0.0.2:80" {
+		t.Fatalf("expected the lower-latency address first, got %v", addrs)
+	}
+}
+
+func TestRecordDialStatAccumulatesEMA(t *testing.T) {
+	dialStatsMu.Lock()
+	dialStats = map[string]*DialerStat{}
+	dialStatsMu.Unlock()
+
+	recordDialStat("example:443", true, 100_000_000) // 100ms
+	recordDialStat("example:443", true, 200_000_000) // 200ms
+
+	stats := DialerStats()
+	if len(stats) != 1 {
+		t.Fatalf("expected 1 dialer stat, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.Successes != 2 || s.Failures != 0 {
+		t.Fatalf("expected 2 successes/0 failures, got %+v", s)
+	}
+	if s.EMALatencyMs <= 100 || s.EMALatencyMs >= 200 {
+		t.Fatalf("expected EMA between the two samples, got %v", s.EMALatencyMs)
+	}
+}
@@ -2,7 +2,6 @@
 package lantern
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -23,7 +22,8 @@ import (
 	"github.com/getlantern/golog"
 	"github.com/getlantern/netx"
 	"github.com/getlantern/protected"
-	"github.com/getlantern/uuid"
+
+	"github.com/iTestinglab/lanternlib/settings"
 
 	proclient "github.com/getlantern/pro-server-client/go-client"
 )
@@ -40,8 +40,6 @@ var (
 
 	// if true, run Lantern against our staging infrastructure
 	stagingMode = "false"
-
-	startOnce sync.Once
 )
 
 func init() {
@@ -54,19 +52,53 @@ type SocketProtector interface {
 	ProtectConn(fileDescriptor int) error
 }
 
+var (
+	overridesMu        sync.Mutex
+	overridesActive    bool
+	overridesDNS       string
+	overridesProtector SocketProtector
+)
+
 // ProtectConnections allows connections made by Lantern to be protected from
 // routing via a VPN. This is useful when running Lantern as a VPN on Android,
 // because it keeps Lantern's own connections from being captured by the VPN and
 // resulting in an infinite loop.
 func ProtectConnections(dnsServer string, protector SocketProtector) {
+	overridesMu.Lock()
+	overridesActive = true
+	overridesDNS = dnsServer
+	overridesProtector = protector
+	overridesMu.Unlock()
+
+	applyOverrides(dnsServer, protector)
+}
+
+func applyOverrides(dnsServer string, protector SocketProtector) {
 	p := protected.New(protector.ProtectConn, dnsServer)
 	netx.OverrideDial(p.Dial)
 	netx.OverrideResolve(p.Resolve)
 }
 
+// reapplyOverrides restores the netx overrides installed by the most recent
+// ProtectConnections call. It's called after every supervised proxy restart
+// since netx.Reset or a fresh process-wide dialer state would otherwise
+// leak VPN-routed connections until ProtectConnections was called again.
+func reapplyOverrides() {
+	overridesMu.Lock()
+	active, dnsServer, protector := overridesActive, overridesDNS, overridesProtector
+	overridesMu.Unlock()
+
+	if active && protector != nil {
+		applyOverrides(dnsServer, protector)
+	}
+}
+
 // RemoveOverrides removes the protected tlsdialer overrides
 // that allowed connections to bypass the VPN.
 func RemoveOverrides() {
+	overridesMu.Lock()
+	overridesActive = false
+	overridesMu.Unlock()
 	netx.Reset()
 }
 
@@ -89,7 +121,16 @@ type UserConfig interface {
 	ConfigUpdate(bool)
 	AfterStart()
 	ShowSurvey(string)
-	BandwidthUpdate(int, int)
+	// BandwidthUpdate reports the percentage of the monthly quota used and
+	// the MiB remaining, plus whether the proxy is currently throttling
+	// throughput (as opposed to having exhausted the quota, which is
+	// signalled by remaining reaching 0).
+	BandwidthUpdate(percent int, remaining int, throttled bool)
+	// ProxyStateChanged reports transitions of the supervised proxy
+	// (Starting, Running, Restarting, Stopped) so the UI can show a
+	// reconnect banner instead of silently hanging on a dead proxy. err is
+	// non-nil when the state changed because of a failure.
+	ProxyStateChanged(state string, err error)
 }
 
 type Updater autoupdate.Updater
@@ -108,13 +149,51 @@ type Updater autoupdate.Updater
 // initial activity may be slow, so clients with low read timeouts may
 // time out.
 func Start(configDir string, locale string, timeoutMillis int, user UserConfig) (*StartResult, error) {
+	return StartWithOptions(configDir, locale, timeoutMillis, user, BandwidthLimits{}, DirectDialPolicy{}, SOCKSPolicy{})
+}
+
+// StartWithOptions is like Start but additionally accepts BandwidthLimits
+// capping per-connection and aggregate read/write throughput of the HTTP and
+// SOCKS5 proxies, a DirectDialPolicy controlling how lantern's own direct dials
+// (SOCKS5 BypassDirect) pick and retry addresses, and a SOCKSPolicy
+// controlling per-port bypass/reject behavior of the SOCKS5 proxy. Pass
+// zero values to get the previous
+// unlimited/default behavior. Bandwidth limits can be changed afterwards,
+// without restarting the proxy, via SetBandwidthLimits and
+// SetPerConnBandwidthLimits.
+func StartWithOptions(configDir string, locale string, timeoutMillis int, user UserConfig, limits BandwidthLimits, policy DirectDialPolicy, socksPolicy SOCKSPolicy) (*StartResult, error) {
 
 	appdir.SetHomeDir(configDir)
+	SetBandwidthLimits(limits.AggregateReadBps, limits.AggregateWriteBps)
+	SetPerConnBandwidthLimits(limits.PerConnReadBps, limits.PerConnWriteBps)
+
+	runStartOnce(func() {
+		go supervise(user, func() { run(configDir, locale, user) })
 
-	startOnce.Do(func() {
-		go run(configDir, locale, user)
+		result, err := startRelays(timeoutMillis, policy, socksPolicy)
+		startResultMu.Lock()
+		startResult, startErr = result, err
+		startResultMu.Unlock()
 	})
 
+	startResultMu.Lock()
+	defer startResultMu.Unlock()
+	return startResult, startErr
+}
+
+var (
+	startResultMu sync.Mutex
+	startResult   *StartResult
+	startErr      error
+)
+
+// startRelays blocks until the underlying flashlight proxy is listening and
+// then fronts it with the throttled HTTP and SOCKS5 relays, returning the
+// addresses callers should connect to. It's only ever invoked once per
+// Start/StartWithOptions cycle, from inside the startOnce guard, so that a
+// second call within the same process reuses the first call's listeners and
+// addresses instead of leaking another pair of them.
+func startRelays(timeoutMillis int, policy DirectDialPolicy, socksPolicy SOCKSPolicy) (*StartResult, error) {
 	start := time.Now()
 	addr, ok := client.Addr(time.Duration(timeoutMillis) * time.Millisecond)
 	if !ok {
@@ -126,7 +205,34 @@ func Start(configDir string, locale string, timeoutMillis int, user UserConfig)
 	if !ok {
 		return nil, fmt.Errorf("SOCKS5 Proxy didn't start within given timeout")
 	}
-	return &StartResult{addr.(string), socksAddr.(string)}, nil
+
+	httpAddr, err := relayThrottled(addr.(string))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start throttled HTTP relay: %v", err)
+	}
+
+	var socks5Addr string
+	if socksPolicy.isEmpty() {
+		// No allowlist or hook configured, so skip the hand-rolled SOCKS5
+		// protocol terminator and just relay bytes, same as the HTTP proxy.
+		socks5Addr, err = relayThrottled(socksAddr.(string))
+	} else {
+		socks5Addr, err = relaySocks5(socksAddr.(string), socksPolicy, policy)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start throttled SOCKS5 relay: %v", err)
+	}
+
+	return &StartResult{httpAddr, socks5Addr}, nil
+}
+
+// resetStartResult clears the memoized relay addresses so the next
+// Start/StartWithOptions after a Stop creates fresh relays instead of
+// handing back the now-closed ones.
+func resetStartResult() {
+	startResultMu.Lock()
+	startResult, startErr = nil, nil
+	startResultMu.Unlock()
 }
 
 // AddLoggingMetadata adds metadata for reporting to cloud logging services
@@ -134,18 +240,26 @@ func AddLoggingMetadata(key, value string) {
 	logging.SetExtraLogglyInfo(key, value)
 }
 
-//userConfig supplies user data for fetching user-specific configuration.
+// userConfig supplies user data for fetching user-specific configuration,
+// backed by the persisted settings store so GetToken/GetUserID reflect
+// whatever the mobile app last set via SetToken/SetUserID.
 type userConfig struct {
+	settings *settings.Settings
 }
 
 func (uc *userConfig) GetToken() string {
-	return ""
+	return uc.settings.GetToken()
 }
 
 func (uc *userConfig) GetUserID() int64 {
-	return 0
+	return uc.settings.GetUserID()
 }
 
+var (
+	currentSettingsMu sync.Mutex
+	currentSettings   *settings.Settings
+)
+
 func run(configDir, locale string, user UserConfig) {
 	flags := make(map[string]interface{})
 	flags["staging"] = false
@@ -160,6 +274,7 @@ func run(configDir, locale string, user UserConfig) {
 		log.Errorf("Unable to enable file logging: %v", err)
 		return
 	}
+	onFileLoggingEnabled()
 	log.Debugf("Writing log messages to %s/lantern.log", configDir)
 
 	staging, err := strconv.ParseBool(stagingMode)
@@ -169,12 +284,21 @@ func run(configDir, locale string, user UserConfig) {
 		log.Errorf("Error parsing boolean flag: %v", err)
 	}
 
+	s, err := settings.Load(configDir)
+	if err != nil {
+		log.Errorf("Unable to load settings: %v", err)
+		return
+	}
+	currentSettingsMu.Lock()
+	currentSettings = s
+	currentSettingsMu.Unlock()
+
 	flashlight.Run("127.0.0.1:0", // listen for HTTP on random address
-		"127.0.0.1:0", // listen for SOCKS on random address
-		configDir,     // place to store lantern configuration
-		false,         // don't make config sticky
-		func() bool { return true },  // proxy all requests
-		make(map[string]interface{}), // no special configuration flags
+		"127.0.0.1:0",               // listen for SOCKS on random address
+		configDir,                   // place to store lantern configuration
+		false,                       // don't make config sticky
+		func() bool { return true }, // proxy all requests
+		flags,
 		func() bool {
 			//beforeStart(user)
 			return true
@@ -185,12 +309,36 @@ func run(configDir, locale string, user UserConfig) {
 		func(cfg *config.Global) {
 			configUpdate(user, cfg)
 		}, // onConfigUpdate
-		&userConfig{},
+		&userConfig{settings: s},
 		func(err error) {}, // onError
-		base64.StdEncoding.EncodeToString(uuid.NodeID()),
+		s.DeviceID,
 	)
 }
 
+// SetToken sets the user's auth token, persisting it so it survives
+// restarts. Start or StartWithOptions must have been called first.
+func SetToken(token string) error {
+	currentSettingsMu.Lock()
+	s := currentSettings
+	currentSettingsMu.Unlock()
+	if s == nil {
+		return fmt.Errorf("Lantern has not been started yet")
+	}
+	return s.SetToken(token)
+}
+
+// SetUserID sets the user's ID, persisting it so it survives restarts.
+// Start or StartWithOptions must have been called first.
+func SetUserID(id int64) error {
+	currentSettingsMu.Lock()
+	s := currentSettings
+	currentSettingsMu.Unlock()
+	if s == nil {
+		return fmt.Errorf("Lantern has not been started yet")
+	}
+	return s.SetUserID(id)
+}
+
 func bandwidthUpdates(user UserConfig) {
 	go func() {
 		for quota := range bandwidth.Updates {
@@ -214,12 +362,13 @@ func bandwidthUpdates(user UserConfig) {
 				remaining = int(quota.MiBAllowed - quota.MiBUsed)
 			}
 
-			user.BandwidthUpdate(percent, remaining)
+			user.BandwidthUpdate(percent, remaining, isThrottled())
 		}
 	}()
 }
 
 func afterStart(user UserConfig, locale string) {
+	reportState(user, Running, nil)
 	bandwidthUpdates(user)
 	user.AfterStart()
 	url, err := surveyRequest(locale)
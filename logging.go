@@ -0,0 +1,294 @@
+package lantern
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/flashlight/client"
+	"github.com/getlantern/golog"
+)
+
+// LogEntry is a single structured log record handed to every registered
+// LogSink.
+type LogEntry struct {
+	Time     time.Time
+	Level    string
+	Logger   string
+	Location string
+	Message  string
+	Metadata map[string]string
+}
+
+// LogSink receives every log line Lantern emits, in addition to the
+// existing Loggly/file logging. Write should not block for long; slow
+// sinks should buffer internally.
+type LogSink interface {
+	Write(entry LogEntry) error
+}
+
+var (
+	logSinksMu sync.Mutex
+	logSinks   []LogSink
+
+	// fileLoggingEnabled tracks whether logging.EnableFileLogging has
+	// already installed golog's file/Loggly outputs, so RegisterLogSink
+	// knows whether there's anything to tee onto yet.
+	fileLoggingEnabled bool
+
+	// teeInstalled guards installLogSinkTee so it only ever wraps golog's
+	// outputs once per process. Without it, onFileLoggingEnabled running
+	// again on every supervised restart would nest another MultiWriter
+	// around the previous one, delivering each line to every sink once
+	// per restart instead of once per line.
+	teeInstalled bool
+)
+
+// RegisterLogSink adds sink to the set of destinations that receive every
+// log line Lantern emits, in addition to the existing console/file/Loggly
+// logging -- it tees onto whatever golog.GetOutputs() currently returns
+// rather than replacing it. Sinks are invoked in registration order; a
+// failing sink only logs its own error and doesn't block the others.
+func RegisterLogSink(sink LogSink) {
+	logSinksMu.Lock()
+	logSinks = append(logSinks, sink)
+	first := len(logSinks) == 1
+	enabled := fileLoggingEnabled
+	logSinksMu.Unlock()
+
+	if first && enabled {
+		installLogSinkTee()
+	}
+}
+
+// onFileLoggingEnabled is called once logging.EnableFileLogging has wired up
+// golog's own console/file/Loggly outputs, so any sinks registered before
+// that point can now be teed onto them instead of being silently dropped or
+// clobbering those outputs.
+func onFileLoggingEnabled() {
+	logSinksMu.Lock()
+	fileLoggingEnabled = true
+	hasSinks := len(logSinks) > 0
+	logSinksMu.Unlock()
+
+	if hasSinks {
+		installLogSinkTee()
+	}
+}
+
+// installLogSinkTee wraps golog's current outputs with a MultiWriter that
+// also fans out to every registered LogSink, preserving whatever console,
+// file, or Loggly writers are already installed. It's a no-op after the
+// first call so repeated invocations (e.g. onFileLoggingEnabled firing on
+// every supervised restart) don't nest another MultiWriter around the one
+// already installed.
+func installLogSinkTee() {
+	logSinksMu.Lock()
+	if teeInstalled {
+		logSinksMu.Unlock()
+		return
+	}
+	teeInstalled = true
+	logSinksMu.Unlock()
+
+	existing := golog.GetOutputs()
+	golog.SetOutputs(&golog.Outputs{
+		ErrorOut: io.MultiWriter(existing.ErrorOut, &logSinkWriter{level: "ERROR"}),
+		DebugOut: io.MultiWriter(existing.DebugOut, &logSinkWriter{level: "DEBUG"}),
+	})
+}
+
+// logSinkWriter adapts golog's io.Writer output convention into LogEntry
+// values fanned out to every registered LogSink.
+type logSinkWriter struct {
+	level string
+}
+
+var logLocationRe = regexp.MustCompile(`[\w./-]+\.go:\d+`)
+
+func (w *logSinkWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := parseGologLine(line, w.level)
+		logSinksMu.Lock()
+		sinks := append([]LogSink{}, logSinks...)
+		logSinksMu.Unlock()
+		for _, sink := range sinks {
+			if err := sink.Write(entry); err != nil {
+				fmt.Fprintf(os.Stderr, "lantern: log sink error: %v\n", err)
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// parseGologLine splits a golog-formatted line ("<logger>: <file.go:123> -
+// deep reason: message with: reason") into its location and message parts,
+// taking care not to mangle embedded URLs that happen to contain "://".
+func parseGologLine(line, level string) LogEntry {
+	entry := LogEntry{Time: time.Now(), Level: level, Message: line}
+
+	if idx := strings.Index(line, ": "); idx > 0 {
+		entry.Logger = line[:idx]
+		line = line[idx+2:]
+	}
+
+	if loc := logLocationRe.FindStringIndex(line); loc != nil && !strings.HasPrefix(line[loc[0]:loc[1]], "//") {
+		entry.Location = line[loc[0]:loc[1]]
+		line = strings.TrimSpace(line[loc[1]:])
+		line = strings.TrimSpace(strings.TrimPrefix(line, "-"))
+	}
+
+	entry.Message = line
+	return entry
+}
+
+// FileSink is a built-in LogSink that appends newline-delimited JSON log
+// entries to a file, rotating it to path+".1" once it grows past maxBytes.
+// A maxBytes of 0 disables rotation.
+type FileSink struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	f        *os.File
+	size     int64
+}
+
+// NewFileSink opens (or creates) path for appending JSON log lines.
+func NewFileSink(path string, maxBytes int64) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileSink{path: path, maxBytes: maxBytes, f: f, size: info.Size()}, nil
+}
+
+func (s *FileSink) Write(entry LogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxBytes > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	s.f.Close()
+	backup := s.path + ".1"
+	os.Remove(backup)
+	if err := os.Rename(s.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.size = 0
+	return nil
+}
+
+// BatchingHTTPSSink is a built-in LogSink that batches entries and POSTs
+// them as newline-delimited JSON to an arbitrary HTTPS endpoint, so users
+// can point logging at Loggly, Datadog, or their own collector without
+// depending on getlantern's infrastructure.
+type BatchingHTTPSSink struct {
+	endpoint  string
+	client    *http.Client
+	batchSize int
+
+	mu      sync.Mutex
+	pending []LogEntry
+}
+
+// NewBatchingHTTPSSink creates a sink that flushes to endpoint every
+// batchSize entries or flushInterval, whichever comes first. When
+// shouldProxy is true, requests are dialed through the running Lantern
+// proxy, mirroring CheckForUpdates.
+func NewBatchingHTTPSSink(endpoint string, shouldProxy bool, batchSize int, flushInterval time.Duration) *BatchingHTTPSSink {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if shouldProxy {
+		if addr, ok := client.Addr(5 * time.Second); ok {
+			if proxyURL, err := url.Parse("http://" + addr.(string)); err == nil {
+				httpClient.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+			}
+		}
+	}
+
+	sink := &BatchingHTTPSSink{endpoint: endpoint, client: httpClient, batchSize: batchSize}
+	go sink.flushPeriodically(flushInterval)
+	return sink
+}
+
+func (s *BatchingHTTPSSink) Write(entry LogEntry) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, entry)
+	shouldFlush := len(s.pending) >= s.batchSize
+	s.mu.Unlock()
+
+	if shouldFlush {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *BatchingHTTPSSink) flushPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.flush()
+	}
+}
+
+func (s *BatchingHTTPSSink) flush() error {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	for _, entry := range batch {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	resp, err := s.client.Post(s.endpoint, "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
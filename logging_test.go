@@ -0,0 +1,94 @@
+package lantern
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGologLineExtractsLocationAndMessage(t *testing.T) {
+	entry := parseGologLine("lantern: lantern.go:100 - deep reason: message with: reason", "ERROR")
+
+	if entry.Logger != "lantern" {
+		t.Fatalf("expected logger %q, got %q", "lantern", entry.Logger)
+	}
+	if entry.Location != "lantern.go:100" {
+		t.Fatalf("expected location %q, got %q", "lantern.go:100", entry.Location)
+	}
+	if entry.Message != "deep reason: message with: reason" {
+		t.Fatalf("expected message to keep embedded colons, got %q", entry.Message)
+	}
+}
+
+func TestParseGologLineWithoutLocationKeepsWholeMessage(t *testing.T) {
+	entry := parseGologLine("lantern: fetching https://example.com/status", "DEBUG")
+
+	if entry.Location != "" {
+		t.Fatalf("expected no location to be extracted, got %q", entry.Location)
+	}
+	if entry.Message != "fetching https://example.com/status" {
+		t.Fatalf("expected the message to be left untouched, got %q", entry.Message)
+	}
+}
+
+func TestFileSinkRotatesAtMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lantern-logsink-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log.jsonl")
+	sink, err := NewFileSink(path, 120)
+	if err != nil {
+		t.Fatalf("unable to create file sink: %v", err)
+	}
+
+	entry := LogEntry{Time: time.Now(), Level: "INFO", Message: strings.Repeat("x", 80)}
+	for i := 0; i < 3; i++ {
+		if err := sink.Write(entry); err != nil {
+			t.Fatalf("unable to write entry: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatalf("expected a rotated backup file to exist: %v", err)
+	}
+}
+
+func TestBatchingHTTPSSinkFlushesAsNDJSON(t *testing.T) {
+	var received []LogEntry
+	done := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			var entry LogEntry
+			if err := json.Unmarshal([]byte(line), &entry); err == nil {
+				received = append(received, entry)
+			}
+		}
+		close(done)
+	}))
+	defer server.Close()
+
+	sink := NewBatchingHTTPSSink(server.URL, false, 2, time.Hour)
+	sink.Write(LogEntry{Level: "INFO", Message: "first"})
+	sink.Write(LogEntry{Level: "INFO", Message: "second"})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for batch to flush")
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("expected 2 entries delivered, got %d", len(received))
+	}
+}
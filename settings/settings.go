@@ -0,0 +1,172 @@
+// Package settings persists Lantern's mobile configuration (device ID,
+// known proxy addresses, user credentials, and user preferences) across
+// runs, replacing the in-memory defaults the lantern package previously
+// regenerated on every start.
+package settings
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/uuid"
+)
+
+var log = golog.LoggerFor("lantern.settings")
+
+const (
+	fileName     = "settings.json"
+	lockName     = "settings.json.lock"
+	staleLockAge = time.Minute
+)
+
+// Settings holds everything about this installation that should survive
+// process restarts.
+type Settings struct {
+	DeviceID          string   `json:"deviceID"`
+	ProxyAddrs        []string `json:"proxyAddrs"`
+	UserToken         string   `json:"userToken"`
+	UserID            int64    `json:"userID"`
+	AutoUpdateChannel string   `json:"autoUpdateChannel"`
+	Staging           bool     `json:"staging"`
+	BandwidthReadBps  int64    `json:"bandwidthReadBps"`
+	BandwidthWriteBps int64    `json:"bandwidthWriteBps"`
+	Locale            string   `json:"locale"`
+
+	mu      sync.Mutex
+	path    string
+	changed chan struct{}
+}
+
+// Load reads settings.json from configDir, creating it with fresh defaults
+// (including a new persisted device ID) if it doesn't exist yet. If the
+// file exists but is corrupt, Load logs the error and falls back to an
+// in-memory default Settings so callers can keep running.
+func Load(configDir string) (*Settings, error) {
+	path := filepath.Join(configDir, fileName)
+	release := acquireLock(filepath.Join(configDir, lockName))
+	defer release()
+
+	s := &Settings{path: path, changed: make(chan struct{}, 1)}
+
+	contents, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		s.DeviceID = newDeviceID()
+		if err := s.Save(); err != nil {
+			log.Errorf("Unable to save initial settings: %v", err)
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(contents, s); err != nil {
+			log.Errorf("Settings file %v is corrupt, falling back to in-memory defaults: %v", path, err)
+			s.DeviceID = newDeviceID()
+		}
+	}
+
+	if s.DeviceID == "" {
+		s.DeviceID = newDeviceID()
+	}
+
+	return s, nil
+}
+
+func newDeviceID() string {
+	return base64.StdEncoding.EncodeToString(uuid.NodeID())
+}
+
+// Save atomically persists the current settings to disk (temp file +
+// rename) and notifies anyone listening on Changed.
+func (s *Settings) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	contents, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Changed receives a notification after Save succeeds. The channel holds at
+// most one pending notification; saves made while one is still unread do
+// not add another.
+func (s *Settings) Changed() <-chan struct{} {
+	return s.changed
+}
+
+// GetToken returns the user's auth token, as set by SetToken.
+func (s *Settings) GetToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.UserToken
+}
+
+// SetToken updates the user's auth token and persists it.
+func (s *Settings) SetToken(token string) error {
+	s.mu.Lock()
+	s.UserToken = token
+	s.mu.Unlock()
+	return s.Save()
+}
+
+// GetUserID returns the user's ID, as set by SetUserID.
+func (s *Settings) GetUserID() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.UserID
+}
+
+// SetUserID updates the user's ID and persists it.
+func (s *Settings) SetUserID(id int64) error {
+	s.mu.Lock()
+	s.UserID = id
+	s.mu.Unlock()
+	return s.Save()
+}
+
+// acquireLock is a best-effort guard against two processes sharing a
+// configDir stomping on each other's settings file while Load reads and
+// possibly rewrites it. It only needs to hold for that brief window, so the
+// returned release func removes the lock file again once Load is done.
+// acquireLock never waits: a lock file older than staleLockAge is removed
+// and taken over, and a younger one held by someone else is only logged,
+// after which Load proceeds without holding the lock, since a mobile app
+// getting stuck unable to start is worse than an occasional racy write.
+func acquireLock(lockPath string) (release func()) {
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err == nil {
+		f.Close()
+		return func() { os.Remove(lockPath) }
+	}
+	if !os.IsExist(err) {
+		log.Errorf("Unable to acquire settings lock %v: %v", lockPath, err)
+		return func() {}
+	}
+	if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > staleLockAge {
+		log.Debugf("Reclaiming stale settings lock %v", lockPath)
+		os.Remove(lockPath)
+		return acquireLock(lockPath)
+	}
+	log.Errorf("Settings lock %v held by another process; proceeding anyway", lockPath)
+	return func() {}
+}
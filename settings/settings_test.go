@@ -0,0 +1,92 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCreatesDefaultsAndPersistsThem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lantern-settings-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.DeviceID == "" {
+		t.Fatal("expected a generated device ID")
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileName)); err != nil {
+		t.Fatalf("expected settings.json to be written: %v", err)
+	}
+}
+
+func TestLoadFallsBackOnCorruptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lantern-settings-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, fileName), []byte("not json"), 0600); err != nil {
+		t.Fatalf("unable to seed corrupt settings file: %v", err)
+	}
+
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatalf("expected Load to recover from a corrupt file, got error: %v", err)
+	}
+	if s.DeviceID == "" {
+		t.Fatal("expected a freshly generated device ID when falling back to defaults")
+	}
+}
+
+func TestLoadReleasesItsOwnLockBetweenRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lantern-settings-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Load(dir); err != nil {
+		t.Fatalf("unexpected error on first load: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, lockName)); err == nil {
+		t.Fatal("expected the settings lock to be released after Load returns")
+	}
+
+	// A second Load simulating a supervised restart must not be blocked by
+	// a leftover lock from the first one.
+	if _, err := Load(dir); err != nil {
+		t.Fatalf("unexpected error on second load: %v", err)
+	}
+}
+
+func TestSaveRoundTripsThroughDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lantern-settings-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Load(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.SetToken("tok-123"); err != nil {
+		t.Fatalf("unexpected error saving token: %v", err)
+	}
+
+	reloaded, err := Load(dir)
+	if err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if reloaded.GetToken() != "tok-123" {
+		t.Fatalf("expected token to round-trip, got %q", reloaded.GetToken())
+	}
+}
@@ -0,0 +1,233 @@
+package lantern
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Decision tells the SOCKS5 relay how to handle a CONNECT request for a
+// given destination.
+type Decision int
+
+const (
+	// DecisionDefault defers to the SOCKSPolicy's port allowlist/fallback.
+	DecisionDefault Decision = iota
+	// BypassDirect dials the destination directly, bypassing the balancer
+	// entirely. Useful for mobile push (5223) or SSH (22) that shouldn't be
+	// routed through Lantern's proxy infrastructure.
+	BypassDirect
+	// RejectWith replies with a SOCKS5 "connection not allowed" error and
+	// closes the connection.
+	RejectWith
+	// ProxyOverCONNECT forwards the request to the balancer's own SOCKS5
+	// server, i.e. the normal Lantern proxying path.
+	ProxyOverCONNECT
+)
+
+// SOCKSPolicy controls how the SOCKS5 proxy handles individual destination
+// ports. Allowlisted ports are dialed directly or rejected according to
+// Fallback; everything else falls through to the balancer.
+type SOCKSPolicy struct {
+	// Allowlist is the set of destination ports this policy has an opinion
+	// about.
+	Allowlist []int
+	// Fallback is applied to ports in Allowlist.
+	Fallback Decision
+	// OnSOCKSRequest, if set, is consulted before Allowlist/Fallback for
+	// every CONNECT request. Returning DecisionDefault defers to the port
+	// allowlist.
+	OnSOCKSRequest func(host string, port int) Decision
+}
+
+// isEmpty reports whether this policy has no opinion about anything,
+// meaning SOCKS5 traffic can skip the hand-rolled protocol terminator below
+// entirely and go through the plain throttled byte relay instead.
+func (p SOCKSPolicy) isEmpty() bool {
+	return len(p.Allowlist) == 0 && p.OnSOCKSRequest == nil
+}
+
+func (p SOCKSPolicy) decide(host string, port int) Decision {
+	if p.OnSOCKSRequest != nil {
+		if d := p.OnSOCKSRequest(host, port); d != DecisionDefault {
+			return d
+		}
+	}
+	for _, allowed := range p.Allowlist {
+		if allowed == port {
+			if p.Fallback == DecisionDefault {
+				return ProxyOverCONNECT
+			}
+			return p.Fallback
+		}
+	}
+	return ProxyOverCONNECT
+}
+
+const (
+	socksVersion5      = 0x05
+	socksCmdConnect    = 0x01
+	socksAtypIPv4      = 0x01
+	socksAtypDomain    = 0x03
+	socksAtypIPv6      = 0x04
+	socksRepOK         = 0x00
+	socksRepNotAllowed = 0x02
+)
+
+// relaySocks5 listens on a random local port, terminates just enough of the
+// SOCKS5 handshake to read the CONNECT request's destination, applies
+// socksPolicy to decide whether to bypass, reject, or hand off to upstream
+// (the balancer's own SOCKS5 server), and splices the connection
+// accordingly. dialPolicy governs retries when bypassing directly.
+func relaySocks5(upstream string, socksPolicy SOCKSPolicy, dialPolicy DirectDialPolicy) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	throttled := newThrottledListener(l)
+	registerListener(throttled)
+
+	go func() {
+		for {
+			conn, err := throttled.Accept()
+			if err != nil {
+				return
+			}
+			go handleSocks5Conn(conn, upstream, socksPolicy, dialPolicy)
+		}
+	}()
+
+	return throttled.Addr().String(), nil
+}
+
+func handleSocks5Conn(client net.Conn, upstream string, socksPolicy SOCKSPolicy, dialPolicy DirectDialPolicy) {
+	defer client.Close()
+
+	greeting, err := readSocks5Greeting(client)
+	if err != nil {
+		log.Debugf("Error reading SOCKS5 greeting: %v", err)
+		return
+	}
+	if _, err := client.Write([]byte{socksVersion5, 0x00}); err != nil {
+		return
+	}
+
+	request, host, port, err := readSocks5Request(client)
+	if err != nil {
+		log.Debugf("Error reading SOCKS5 request: %v", err)
+		return
+	}
+
+	switch socksPolicy.decide(host, port) {
+	case BypassDirect:
+		dialDirect(client, host, port, dialPolicy)
+	case RejectWith:
+		client.Write([]byte{socksVersion5, socksRepNotAllowed, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	default: // ProxyOverCONNECT and DecisionDefault
+		proxyOverConnect(client, upstream, greeting, request)
+	}
+}
+
+// dialDirect bypasses the balancer and connects straight to host:port,
+// replying to the client itself before splicing the two connections.
+func dialDirect(client net.Conn, host string, port int, policy DirectDialPolicy) {
+	up, err := dialWithPolicy(policy, host, port)
+	if err != nil {
+		client.Write([]byte{socksVersion5, 0x05, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer up.Close()
+	if _, err := client.Write([]byte{socksVersion5, socksRepOK, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	splice(client, up)
+}
+
+// proxyOverConnect replays the original SOCKS5 handshake bytes to upstream
+// (the balancer's own SOCKS5 server) verbatim, then splices the connections
+// so the balancer handles proxying as usual.
+func proxyOverConnect(client net.Conn, upstream string, greeting, request []byte) {
+	up, err := net.Dial("tcp", upstream)
+	if err != nil {
+		log.Errorf("Unable to dial upstream SOCKS5 server %v: %v", upstream, err)
+		return
+	}
+	defer up.Close()
+
+	if _, err := up.Write(greeting); err != nil {
+		return
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(up, reply); err != nil {
+		return
+	}
+	if _, err := up.Write(request); err != nil {
+		return
+	}
+	splice(client, up)
+}
+
+func readSocks5Greeting(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion5 {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	nmethods := int(header[1])
+	methods := make([]byte, nmethods)
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	return append(header, methods...), nil
+}
+
+func readSocks5Request(r io.Reader) (raw []byte, host string, port int, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, "", 0, err
+	}
+	if header[0] != socksVersion5 || header[1] != socksCmdConnect {
+		return nil, "", 0, fmt.Errorf("unsupported SOCKS5 request ver=%d cmd=%d", header[0], header[1])
+	}
+
+	var addr []byte
+	switch header[3] {
+	case socksAtypIPv4:
+		addr = make([]byte, 4)
+		if _, err = io.ReadFull(r, addr); err != nil {
+			return nil, "", 0, err
+		}
+		host = net.IP(addr).String()
+	case socksAtypDomain:
+		lenBuf := make([]byte, 1)
+		if _, err = io.ReadFull(r, lenBuf); err != nil {
+			return nil, "", 0, err
+		}
+		domain := make([]byte, int(lenBuf[0]))
+		if _, err = io.ReadFull(r, domain); err != nil {
+			return nil, "", 0, err
+		}
+		host = string(domain)
+		addr = append(lenBuf, domain...)
+	case socksAtypIPv6:
+		addr = make([]byte, 16)
+		if _, err = io.ReadFull(r, addr); err != nil {
+			return nil, "", 0, err
+		}
+		host = net.IP(addr).String()
+	default:
+		return nil, "", 0, fmt.Errorf("unsupported SOCKS5 address type %d", header[3])
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err = io.ReadFull(r, portBuf); err != nil {
+		return nil, "", 0, err
+	}
+	port = int(portBuf[0])<<8 | int(portBuf[1])
+
+	raw = append(header, addr...)
+	raw = append(raw, portBuf...)
+	return raw, host, port, nil
+}
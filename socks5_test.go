@@ -0,0 +1,74 @@
+package lantern
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadSocks5RequestIPv4(t *testing.T) {
+	// ver=5 cmd=CONNECT rsv=0 atyp=IPv4, 93.184.216.34:443
+	buf := []byte{0x05, 0x01, 0x00, 0x01, 93, 184, 216, 34, 0x01, 0xBB}
+	raw, host, port, err := readSocks5Request(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if host != "93.184.216.34" || port != 443 {
+		t.Fatalf("expected 93.184.216.34:443, got %s:%d", host, port)
+	}
+	if !bytes.Equal(raw, buf) {
+		t.Fatalf("expected raw bytes to round-trip, got %v want %v", raw, buf)
+	}
+}
+
+func TestReadSocks5RequestDomain(t *testing.T) {
+	domain := "example.com"
+	buf := []byte{0x05, 0x01, 0x00, 0x03, byte(len(domain))}
+	buf = append(buf, domain...)
+	buf = append(buf, 0x00, 0x50) // port 80
+
+	_, host, port, err := readSocks5Request(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if host != domain || port != 80 {
+		t.Fatalf("expected %s:80, got %s:%d", domain, host, port)
+	}
+}
+
+func TestSOCKSPolicyDecide(t *testing.T) {
+	policy := SOCKSPolicy{
+		Allowlist: []int{22, 5223},
+		Fallback:  BypassDirect,
+	}
+
+	if d := policy.decide("example.com", 22); d != BypassDirect {
+		t.Fatalf("expected BypassDirect for allowlisted port, got %v", d)
+	}
+	if d := policy.decide("example.com", 443); d != ProxyOverCONNECT {
+		t.Fatalf("expected ProxyOverCONNECT for a non-allowlisted port, got %v", d)
+	}
+
+	hooked := SOCKSPolicy{
+		OnSOCKSRequest: func(host string, port int) Decision {
+			if host == "blocked.example.com" {
+				return RejectWith
+			}
+			return DecisionDefault
+		},
+	}
+	if d := hooked.decide("blocked.example.com", 443); d != RejectWith {
+		t.Fatalf("expected the hook's decision to win, got %v", d)
+	}
+	if d := hooked.decide("other.example.com", 443); d != ProxyOverCONNECT {
+		t.Fatalf("expected default fallthrough when the hook defers, got %v", d)
+	}
+}
+
+func TestSOCKSPolicyIsEmpty(t *testing.T) {
+	if !(SOCKSPolicy{}).isEmpty() {
+		t.Fatalf("expected zero-value SOCKSPolicy to be empty")
+	}
+	if (SOCKSPolicy{Allowlist: []int{22}}).isEmpty() {
+		t.Fatalf("expected a policy with an allowlist to not be empty")
+	}
+}
@@ -0,0 +1,142 @@
+package lantern
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ProxyState describes the lifecycle of the supervised proxy goroutine.
+type ProxyState string
+
+const (
+	Starting   ProxyState = "starting"
+	Running    ProxyState = "running"
+	Restarting ProxyState = "restarting"
+	Stopped    ProxyState = "stopped"
+)
+
+const (
+	initialBackoff = 1 * time.Second
+	maxBackoff     = 60 * time.Second
+	// failureWindow bounds how far back a prior failure still counts
+	// towards the flap detector below.
+	failureWindow = 10 * time.Minute
+	// flapCoolDown is used instead of the exponential backoff once two
+	// failures have landed within failureWindow, to avoid a tight crash
+	// loop against a consistently broken config.
+	flapCoolDown = 5 * time.Minute
+)
+
+var (
+	supervisorMu   sync.Mutex
+	supervisorStop chan struct{}
+
+	// startOnce guards against starting a second supervisor goroutine
+	// while one is already running. It's swapped out for a fresh one in
+	// Stop so that a later Start/StartWithOptions can spin the supervisor
+	// back up; every read and write of the pointer itself goes through
+	// supervisorMu since sync.Once only makes Do safe, not reassignment
+	// of the variable holding it.
+	startOnce = &sync.Once{}
+)
+
+// runStartOnce calls f via the current startOnce, the way
+// startOnce.Do(f) would, but without racing a concurrent Stop that
+// replaces startOnce with a fresh one.
+func runStartOnce(f func()) {
+	supervisorMu.Lock()
+	once := startOnce
+	supervisorMu.Unlock()
+	once.Do(f)
+}
+
+// supervise runs runFunc in a loop, restarting it with exponential backoff
+// whenever it returns or panics, until Stop is called. Two failures within
+// failureWindow trigger a longer flapCoolDown instead of continuing to back
+// off exponentially, since a dead proxy an Android app can't recover from
+// is worse than a slow-to-reconnect one.
+func supervise(user UserConfig, runFunc func()) {
+	stop := make(chan struct{})
+	supervisorMu.Lock()
+	supervisorStop = stop
+	supervisorMu.Unlock()
+
+	reportState(user, Starting, nil)
+
+	backoff := initialBackoff
+	var failures []time.Time
+
+	for {
+		select {
+		case <-stop:
+			reportState(user, Stopped, nil)
+			return
+		default:
+		}
+
+		runOnce(runFunc)
+		reportState(user, Restarting, fmt.Errorf("proxy exited unexpectedly"))
+
+		now := time.Now()
+		failures = append(failures, now)
+		cutoff := now.Add(-failureWindow)
+		for len(failures) > 0 && failures[0].Before(cutoff) {
+			failures = failures[1:]
+		}
+
+		wait := backoff
+		if len(failures) >= 2 {
+			wait = flapCoolDown
+		}
+
+		select {
+		case <-stop:
+			reportState(user, Stopped, nil)
+			return
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		reapplyOverrides()
+	}
+}
+
+func runOnce(runFunc func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic in proxy run loop: %v", r)
+		}
+	}()
+	runFunc()
+}
+
+func reportState(user UserConfig, state ProxyState, err error) {
+	if user == nil {
+		return
+	}
+	user.ProxyStateChanged(string(state), err)
+}
+
+// Stop shuts down the supervised proxy loop and closes the relay listeners
+// it opened. Start or StartWithOptions can be called again afterwards to
+// start a new one. A run already in progress is not interrupted: the loop
+// exits, without restarting it, once that run returns, and Stopped is
+// reported then.
+func Stop() {
+	supervisorMu.Lock()
+	stop := supervisorStop
+	supervisorStop = nil
+	startOnce = &sync.Once{}
+	supervisorMu.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+	closeActiveListeners()
+	resetStartResult()
+}
@@ -0,0 +1,40 @@
+package lantern
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunStartOnceRunsExactlyOnce(t *testing.T) {
+	var calls int32
+	for i := 0; i < 5; i++ {
+		runStartOnce(func() { atomic.AddInt32(&calls, 1) })
+	}
+	if calls != 1 {
+		t.Fatalf("expected runStartOnce to only invoke its func once, got %d calls", calls)
+	}
+
+	Stop()
+
+	for i := 0; i < 5; i++ {
+		runStartOnce(func() { atomic.AddInt32(&calls, 1) })
+	}
+	if calls != 2 {
+		t.Fatalf("expected Stop to reset startOnce so the next round runs again, got %d calls", calls)
+	}
+}
+
+func TestStopClosesRegisteredListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to open listener: %v", err)
+	}
+	registerListener(l)
+
+	Stop()
+
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("expected the listener to be closed after Stop")
+	}
+}
@@ -0,0 +1,256 @@
+package lantern
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// BandwidthLimits caps the throughput of the HTTP and SOCKS5 proxies, in
+// bytes/sec. A value of 0 means unlimited. The per-connection limits apply
+// independently to each accepted connection; the aggregate limits apply
+// across all connections combined.
+type BandwidthLimits struct {
+	PerConnReadBps    int64
+	PerConnWriteBps   int64
+	AggregateReadBps  int64
+	AggregateWriteBps int64
+}
+
+var (
+	bandwidthMu          sync.Mutex
+	aggregateReadBucket  *ratelimit.Bucket
+	aggregateWriteBucket *ratelimit.Bucket
+	perConnReadBps       int64
+	perConnWriteBps      int64
+)
+
+// SetBandwidthLimits (re)configures the aggregate bandwidth caps applied
+// across all connections combined. It can be called at any time, including
+// while the proxy is already running, so that a mobile UI can tune limits
+// without restarting it. A limit of 0 means unlimited. Use
+// SetPerConnBandwidthLimits to configure the separate per-connection caps.
+func SetBandwidthLimits(readBps, writeBps int64) {
+	bandwidthMu.Lock()
+	defer bandwidthMu.Unlock()
+	aggregateReadBucket = newBucket(readBps)
+	aggregateWriteBucket = newBucket(writeBps)
+}
+
+// SetPerConnBandwidthLimits (re)configures the bandwidth caps applied to
+// each connection individually. Like SetBandwidthLimits, it takes effect
+// for connections accepted afterwards and can be called at any time. A
+// limit of 0 means unlimited.
+func SetPerConnBandwidthLimits(readBps, writeBps int64) {
+	bandwidthMu.Lock()
+	defer bandwidthMu.Unlock()
+	perConnReadBps = readBps
+	perConnWriteBps = writeBps
+}
+
+func init() {
+	go monitorThrottling()
+}
+
+var (
+	throttledNowMu sync.Mutex
+	throttledNow   bool
+)
+
+// monitorThrottling periodically samples whether the aggregate buckets are
+// currently drained, independent of when (or whether) a bandwidth.Updates
+// quota event happens to arrive, so isThrottled reflects real-time state
+// rather than a stale reading from the last quota message.
+func monitorThrottling() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		bandwidthMu.Lock()
+		aggRead, aggWrite := aggregateReadBucket, aggregateWriteBucket
+		bandwidthMu.Unlock()
+
+		throttled := (aggRead != nil && aggRead.Available() <= 0) ||
+			(aggWrite != nil && aggWrite.Available() <= 0)
+
+		throttledNowMu.Lock()
+		throttledNow = throttled
+		throttledNowMu.Unlock()
+	}
+}
+
+// isThrottled reports whether the aggregate buckets were drained as of the
+// last monitorThrottling tick, meaning throughput is being capped rather
+// than the user's data quota being exhausted.
+func isThrottled() bool {
+	throttledNowMu.Lock()
+	defer throttledNowMu.Unlock()
+	return throttledNow
+}
+
+func newBucket(rateBps int64) *ratelimit.Bucket {
+	if rateBps <= 0 {
+		return nil
+	}
+	return ratelimit.NewBucketWithRate(float64(rateBps), rateBps)
+}
+
+// throttledListener wraps a net.Listener so that every accepted connection's
+// Read and Write calls draw from the current aggregate and per-connection
+// token buckets.
+type throttledListener struct {
+	net.Listener
+}
+
+func newThrottledListener(l net.Listener) net.Listener {
+	return &throttledListener{l}
+}
+
+func (l *throttledListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return wrapWithBandwidthLimits(conn), nil
+}
+
+// wrapWithBandwidthLimits returns conn wrapped so its Read/Write throughput
+// is metered against both the shared aggregate buckets and a fresh pair of
+// per-connection buckets built from the limits currently in effect.
+func wrapWithBandwidthLimits(conn net.Conn) net.Conn {
+	bandwidthMu.Lock()
+	aggRead, aggWrite := aggregateReadBucket, aggregateWriteBucket
+	connReadBucket := newBucket(perConnReadBps)
+	connWriteBucket := newBucket(perConnWriteBps)
+	bandwidthMu.Unlock()
+
+	var reader io.Reader = conn
+	if connReadBucket != nil {
+		reader = ratelimit.Reader(reader, connReadBucket)
+	}
+	if aggRead != nil {
+		reader = ratelimit.Reader(reader, aggRead)
+	}
+
+	var writer io.Writer = conn
+	if connWriteBucket != nil {
+		writer = ratelimit.Writer(writer, connWriteBucket)
+	}
+	if aggWrite != nil {
+		writer = ratelimit.Writer(writer, aggWrite)
+	}
+
+	return &throttledConn{Conn: conn, reader: reader, writer: writer}
+}
+
+// throttledConn is a net.Conn whose Read and Write are metered through one
+// or more ratelimit.Bucket chains.
+type throttledConn struct {
+	net.Conn
+	reader io.Reader
+	writer io.Writer
+}
+
+func (c *throttledConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c *throttledConn) Write(b []byte) (int, error) { return c.writer.Write(b) }
+
+// CloseWrite delegates to the underlying connection's half-close, if it
+// supports one, so splice's half-close logic works through the wrapper.
+func (c *throttledConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloseWriter); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// relayThrottled listens on a random local port, accepts connections
+// wrapped with the current bandwidth limits, and forwards them to upstream.
+// It returns the address callers should connect to in place of upstream.
+func relayThrottled(upstream string) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	throttled := newThrottledListener(l)
+	registerListener(throttled)
+
+	go func() {
+		for {
+			conn, err := throttled.Accept()
+			if err != nil {
+				return
+			}
+			go relayConn(conn, upstream)
+		}
+	}()
+
+	return throttled.Addr().String(), nil
+}
+
+func relayConn(client net.Conn, upstream string) {
+	defer client.Close()
+	up, err := net.Dial("tcp", upstream)
+	if err != nil {
+		log.Errorf("Unable to dial upstream %v: %v", upstream, err)
+		return
+	}
+	defer up.Close()
+
+	splice(client, up)
+}
+
+// splice copies in both directions between a and b, half-closing each
+// side's write end as its source reaches EOF, and only returns once both
+// directions have finished. Returning after just one direction would let
+// the caller tear down both connections while the other direction still
+// has data in flight.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyHalfClose(b, a)
+	}()
+	go func() {
+		defer wg.Done()
+		copyHalfClose(a, b)
+	}()
+	wg.Wait()
+}
+
+type halfCloseWriter interface {
+	CloseWrite() error
+}
+
+func copyHalfClose(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if hc, ok := dst.(halfCloseWriter); ok {
+		hc.CloseWrite()
+	}
+}
+
+var (
+	listenersMu     sync.Mutex
+	activeListeners []net.Listener
+)
+
+// registerListener tracks l so Stop can close it, preventing relay
+// listeners and their accept loops from leaking across Stop/Start cycles.
+func registerListener(l net.Listener) {
+	listenersMu.Lock()
+	activeListeners = append(activeListeners, l)
+	listenersMu.Unlock()
+}
+
+func closeActiveListeners() {
+	listenersMu.Lock()
+	ls := activeListeners
+	activeListeners = nil
+	listenersMu.Unlock()
+
+	for _, l := range ls {
+		l.Close()
+	}
+}
@@ -0,0 +1,33 @@
+package lantern
+
+import "testing"
+
+func TestBandwidthLimitsAreIndependent(t *testing.T) {
+	SetBandwidthLimits(1000, 2000)
+	SetPerConnBandwidthLimits(10, 20)
+
+	bandwidthMu.Lock()
+	aggRead, aggWrite := aggregateReadBucket, aggregateWriteBucket
+	connRead, connWrite := perConnReadBps, perConnWriteBps
+	bandwidthMu.Unlock()
+
+	if aggRead == nil || aggRead.Rate() != 1000 {
+		t.Fatalf("expected aggregate read rate 1000, got %v", aggRead)
+	}
+	if aggWrite == nil || aggWrite.Rate() != 2000 {
+		t.Fatalf("expected aggregate write rate 2000, got %v", aggWrite)
+	}
+	if connRead != 10 || connWrite != 20 {
+		t.Fatalf("expected per-conn rates 10/20, got %d/%d", connRead, connWrite)
+	}
+
+	// Changing the aggregate limit must not disturb the per-connection one,
+	// and vice versa.
+	SetBandwidthLimits(5000, 6000)
+	bandwidthMu.Lock()
+	connRead, connWrite = perConnReadBps, perConnWriteBps
+	bandwidthMu.Unlock()
+	if connRead != 10 || connWrite != 20 {
+		t.Fatalf("expected per-conn rates to survive an aggregate update, got %d/%d", connRead, connWrite)
+	}
+}